@@ -1,5 +1,25 @@
 package infohash
 
+// CalculateParity computes the Hamming-style parity words used to
+// localize which of the given field hashes changed. It is exported so
+// that sibling packages which build their own per-field hash list (e.g.
+// infohash/proto, keyed off protobuf field numbers instead of struct
+// tags) can feed it into the same localization scheme HashStruct uses.
+func CalculateParity(fieldHashes []uint32) []uint32 {
+	return calculateHammingCode(fieldHashes)
+}
+
+// FindChangedField returns the position of the single field that
+// changed, given the current field hashes and a previously computed
+// parity. ok is false when no field changed, or when the parity
+// difference does not point at a valid field position, in which case
+// position is meaningless. When several fields changed, the combined
+// parity difference can still point at a valid position, and ok is then
+// true with the position of a field that did not necessarily change.
+func FindChangedField(fieldHashes []uint32, parity []uint32) (ok bool, position uint32) {
+	return findErrorLocation(fieldHashes, parity)
+}
+
 func calculateHammingCode(fields []uint32) []uint32 {
 	log2NumberOfFieldsPlusOne := log2OfXPlusOne(uint32(len(fields)))
 	parityCodes := make([]uint32, log2NumberOfFieldsPlusOne)
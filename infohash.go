@@ -6,6 +6,7 @@ import (
 	"io"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
@@ -13,6 +14,11 @@ import (
 
 const tagName = "infohash"
 
+// FieldChangedError is returned by CompareHashStruct when the hash does
+// not match. Field holds the changed field's tag name, or its dotted path
+// (e.g. "Spec.Containers[].Image") when the change was localized inside
+// a nested tagged struct. Field is empty when the change could not be
+// localized to a single field.
 type FieldChangedError struct {
 	Field string
 }
@@ -25,12 +31,23 @@ func (e FieldChangedError) Error() string {
 	return fmt.Sprintf("the field %q's value changed", e.Field)
 }
 
+// Hashable lets a type take over hashing its own value. If a field's
+// value implements Hashable, getHashes uses InfoHash's result instead of
+// spew-printing the value. This is useful for types whose zero-value
+// handling or textual representation is not stable across Go or
+// dependency versions, e.g. time.Time, *big.Int, or Kubernetes'
+// resource.Quantity.
+type Hashable interface {
+	InfoHash() ([]byte, error)
+}
+
 type fieldInfo struct {
 	name       string
 	fieldValue interface{}
+	asString   bool
 }
 
-func getFieldInfos(obj interface{}) ([]fieldInfo, error) {
+func getFieldInfos(obj interface{}, tagName string, zeroNil bool) ([]fieldInfo, error) {
 	vObj := reflect.ValueOf(obj)
 	if vObj.Kind() != reflect.Ptr {
 		return nil, fmt.Errorf("the object must be a pointer")
@@ -41,7 +58,26 @@ func getFieldInfos(obj interface{}) ([]fieldInfo, error) {
 		return nil, fmt.Errorf("the object must be a pointer to a struct")
 	}
 
-	t := reflect.TypeOf(obj).Elem()
+	return getStructFieldInfos(v, tagName, zeroNil)
+}
+
+// getStructFieldInfos collects the fieldInfos for every tagged field of
+// the addressable struct value v. A field whose type (or element type,
+// for pointers/slices/arrays/maps) is itself a struct carrying tagName
+// tags is expanded into dotted leaf fieldInfos instead of being hashed
+// as a single opaque value; see expandNestedFieldInfos.
+//
+// A tag of "-" drops the field entirely: it is excluded from both the
+// hash and the structural hash checked by TestStructDefinition. A tag
+// option of ",omitempty" drops the field only when its value is the
+// zero value, which lets a field be added to a struct without
+// invalidating hashes produced before it existed; note that toggling
+// omitempty on an existing field still changes which fields a given
+// value hashes, which is a breaking change like any other tag edit. A
+// tag option of ",string" hashes fmt.Sprintf("%v", value) instead of
+// the value's spew representation.
+func getStructFieldInfos(v reflect.Value, tagName string, zeroNil bool) ([]fieldInfo, error) {
+	t := v.Type()
 
 	fieldInfos := make([]fieldInfo, 0, t.NumField())
 	tags := make(map[string]struct{})
@@ -49,12 +85,32 @@ func getFieldInfos(obj interface{}) ([]fieldInfo, error) {
 		structField := t.Field(i)
 		fieldValue := v.Field(i)
 
-		tag := structField.Tag.Get(tagName)
+		rawTag := structField.Tag.Get(tagName)
 
-		if tag == "" {
+		if rawTag == "" {
 			return nil, fmt.Errorf("the field %s has no tag %s", structField.Name, tagName)
 		}
 
+		if rawTag == "-" {
+			continue
+		}
+
+		tag, omitempty, asString := parseTag(rawTag)
+
+		if omitempty && fieldValue.IsZero() {
+			continue
+		}
+
+		nested, expanded, err := expandNestedFieldInfos(tagName, tag, fieldValue, zeroNil)
+		if err != nil {
+			return nil, err
+		}
+
+		if expanded {
+			fieldInfos = append(fieldInfos, nested...)
+			continue
+		}
+
 		if _, ok := tags[tag]; ok {
 			return nil, fmt.Errorf("the tag %q is used more than once", tag)
 		}
@@ -63,6 +119,7 @@ func getFieldInfos(obj interface{}) ([]fieldInfo, error) {
 		fieldInfos = append(fieldInfos, fieldInfo{
 			name:       tag,
 			fieldValue: fieldValue.Addr().Interface(),
+			asString:   asString,
 		})
 	}
 
@@ -73,11 +130,30 @@ func getFieldInfos(obj interface{}) ([]fieldInfo, error) {
 	return fieldInfos, nil
 }
 
-func getHashes(fieldInfos []fieldInfo) (uint64, []uint32, error) {
+// parseTag splits a tag value into its field name and options, in the
+// same "name,option,option" shape encoding/json uses. Unrecognized
+// options are ignored.
+func parseTag(rawTag string) (name string, omitempty, asString bool) {
+	parts := strings.Split(rawTag, ",")
+	name = parts[0]
+
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "omitempty":
+			omitempty = true
+		case "string":
+			asString = true
+		}
+	}
+
+	return name, omitempty, asString
+}
+
+func getHashes(fieldInfos []fieldInfo, opts *HashOptions) (uint64, []uint32, error) {
 	fieldHashes := make([]uint32, 0, len(fieldInfos))
 
-	fullHash := fnv.New64a()
-	fieldHash := fnv.New32a()
+	fullHash := opts.Hasher()
+	fieldHash := opts.FieldHasher()
 	multiWriter := io.MultiWriter(fullHash, fieldHash)
 
 	for _, info := range fieldInfos {
@@ -87,8 +163,31 @@ func getHashes(fieldInfos []fieldInfo) (uint64, []uint32, error) {
 			return 0, nil, err
 		}
 
-		if _, err := prettyPrintConfigForHash.Fprintf(multiWriter, "%#v", info.fieldValue); err != nil {
-			return 0, nil, err
+		fieldValue := info.fieldValue
+		if opts.ZeroNil {
+			fieldValue = zeroNilValue(fieldValue)
+		}
+
+		switch hashable, ok := asHashable(fieldValue); {
+		case ok:
+			b, err := hashable.InfoHash()
+			if err != nil {
+				return 0, nil, err
+			}
+			if _, err := multiWriter.Write(b); err != nil {
+				return 0, nil, err
+			}
+
+		case info.asString:
+			value := reflect.ValueOf(fieldValue).Elem().Interface()
+			if _, err := fmt.Fprintf(multiWriter, "%v", value); err != nil {
+				return 0, nil, err
+			}
+
+		default:
+			if _, err := prettyPrintConfigForHash.Fprintf(multiWriter, "%#v", fieldValue); err != nil {
+				return 0, nil, err
+			}
 		}
 
 		fieldHashes = append(fieldHashes, fieldHash.Sum32())
@@ -97,11 +196,59 @@ func getHashes(fieldInfos []fieldInfo) (uint64, []uint32, error) {
 	return fullHash.Sum64(), fieldHashes, nil
 }
 
+// asHashable reports whether fieldValue -- or, failing that, the value
+// it points to -- implements Hashable. fieldValue is always one level
+// more indirect than the field's own type (see getStructFieldInfos), so
+// for a field whose static type is itself a pointer, e.g. *big.Int,
+// fieldValue is a **big.Int and only the dereferenced *big.Int implements
+// Hashable; checking fieldValue directly would never match.
+func asHashable(fieldValue interface{}) (Hashable, bool) {
+	if h, ok := fieldValue.(Hashable); ok {
+		return h, true
+	}
+
+	rv := reflect.ValueOf(fieldValue)
+	if rv.Kind() != reflect.Ptr {
+		return nil, false
+	}
+
+	elem := rv.Elem()
+	if !elem.IsValid() || !elem.CanInterface() {
+		return nil, false
+	}
+
+	h, ok := elem.Interface().(Hashable)
+	return h, ok
+}
+
+// zeroNilValue takes a pointer to a field's value (as produced by
+// getFieldInfos) and, if the field itself is a nil pointer, returns a
+// pointer to the zero value of the pointed-to type instead. This makes
+// a nil field and an explicitly zeroed field hash identically when
+// HashOptions.ZeroNil is set.
+func zeroNilValue(fieldValue interface{}) interface{} {
+	rv := reflect.ValueOf(fieldValue).Elem()
+	if rv.Kind() != reflect.Ptr || !rv.IsNil() {
+		return fieldValue
+	}
+
+	replacement := reflect.New(rv.Type())
+	replacement.Elem().Set(reflect.New(rv.Type().Elem()))
+
+	return replacement.Interface()
+}
+
 // This test function must be added to the unit tests in your project.
 // It will make sure that the defined fields of the struct are not
-// changed, which would yield all calculated hashes invalid.
+// changed, which would yield all calculated hashes invalid. A field
+// tagged "-" never contributes to this hash; a field tagged with
+// ",omitempty" only contributes when obj's value for it is non-zero, so
+// pass an obj with every omitempty field populated to get full coverage.
+// Changing whether a field has the "-" tag or an ",omitempty" option is,
+// like renaming the field, a breaking change: it requires passing a new
+// expectedHash.
 func TestStructDefinition(t *testing.T, obj interface{}, expectedHash []byte) {
-	fieldInfos, err := getFieldInfos(obj)
+	fieldInfos, err := getFieldInfos(obj, tagName, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -124,27 +271,61 @@ func TestStructDefinition(t *testing.T, obj interface{}, expectedHash []byte) {
 // the tag value must be unique for each field. The tag value is used as
 // the name of the field in the returned error in case of a mismatch.
 //
+// If a field's type (or its element type, for pointers/slices/arrays/maps)
+// is itself a struct with "infohash" tags, that field is expanded into its
+// leaf fields instead of being hashed as a single opaque value, and those
+// leaves are reported as dotted paths, e.g. "Spec.Containers[].Image".
+//
 // The CompareHashStruct function can be used to compare the hash of a struct
 // with a previously calculated hash and return an error if the struct has changed.
 // The error contains the name of the field that has changed.
+//
+// HashStruct is equivalent to HashStructWithOptions(obj, nil).
 func HashStruct(obj interface{}) ([]byte, error) {
-	fieldInfos, err := getFieldInfos(obj)
+	return HashStructWithOptions(obj, nil)
+}
+
+// HashStructWithOptions is like HashStruct, but lets the caller choose the
+// struct tag, the hash algorithms, and the on-disk format via options. A
+// nil options uses the same defaults as HashStruct.
+func HashStructWithOptions(obj interface{}, options *HashOptions) ([]byte, error) {
+	opts := options.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	fieldInfos, err := getFieldInfos(obj, opts.TagName, opts.ZeroNil)
 	if err != nil {
 		return nil, err
 	}
-	return hashInfo(fieldInfos)
+
+	return hashInfo(fieldInfos, opts)
 }
 
-func hashInfo(fieldInfos []fieldInfo) ([]byte, error) {
-	fullHash, fieldHashes, err := getHashes(fieldInfos)
+func hashInfo(fieldInfos []fieldInfo, opts *HashOptions) ([]byte, error) {
+	fullHash, fieldHashes, err := getHashes(fieldInfos, opts)
 	if err != nil {
 		return nil, err
 	}
 	hammingCode := calculateHammingCode(fieldHashes)
 
-	combinedHash := make([]byte, 0, (64+32*len(hammingCode))/8)
+	var syndromes []uint32
+	if opts.Format == FormatV2 {
+		syndromes = calculateSyndromes(fieldHashes, opts.MaxChanges)
+	}
+
+	// The number of Hamming parity words and syndromes is stored
+	// explicitly (rather than inferred from the comparand's field count)
+	// because that count can legitimately differ between hash time and
+	// compare time, e.g. an ",omitempty" field being set or cleared, or a
+	// nested slice/map changing length. Without this, CompareHashStructWithOptions
+	// would mis-slice the body or index past it.
+	combinedHash := make([]byte, 0, 3+(64+32*len(hammingCode)+32*len(syndromes))/8)
+	combinedHash = append(combinedHash, byte(opts.Format))
+	combinedHash = append(combinedHash, byte(len(hammingCode)), byte(len(syndromes)))
 	combinedHash = append(combinedHash, uint64ToSlice(fullHash)...)
 	combinedHash = append(combinedHash, uint32SliceToByteSlice(hammingCode)...)
+	combinedHash = append(combinedHash, uint32SliceToByteSlice(syndromes)...)
 
 	return combinedHash, nil
 }
@@ -159,23 +340,88 @@ func hashInfo(fieldInfos []fieldInfo) ([]byte, error) {
 // If the hash does not match, the function returns a FieldChangedError.
 // If there is only one field that has changed, the error contains the name of the field.
 // If there are multiple fields that have changed, the error contains an empty string.
+//
+// CompareHashStruct is equivalent to CompareHashStructWithOptions(obj, existingHash, nil).
 func CompareHashStruct(obj interface{}, existingHash []byte) error {
-	fieldInfos, err := getFieldInfos(obj)
+	return CompareHashStructWithOptions(obj, existingHash, nil)
+}
+
+// CompareHashStructWithOptions is like CompareHashStruct, but lets the
+// caller choose the struct tag, the hash algorithms, and the expected
+// on-disk format via options. A nil options uses the same defaults as
+// CompareHashStruct. The options passed here must match the ones used to
+// produce existingHash, otherwise an error is returned.
+func CompareHashStructWithOptions(obj interface{}, existingHash []byte, options *HashOptions) error {
+	opts := options.withDefaults()
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	if len(existingHash) < 3 {
+		return fmt.Errorf("the existing hash is too short")
+	}
+
+	if format := Format(existingHash[0]); format != opts.Format {
+		return fmt.Errorf("the existing hash has format %d, but format %d was requested", format, opts.Format)
+	}
+
+	hammingCodeLen := int(existingHash[1])
+	syndromeLen := int(existingHash[2])
+	body := existingHash[3:]
+
+	if len(body) != 8+4*hammingCodeLen+4*syndromeLen {
+		return fmt.Errorf("the existing hash has an unexpected length")
+	}
+
+	if syndromeLen != opts.MaxChanges-1 {
+		return fmt.Errorf("the existing hash has %d syndromes, but MaxChanges %d was requested", syndromeLen, opts.MaxChanges)
+	}
+
+	fieldInfos, err := getFieldInfos(obj, opts.TagName, opts.ZeroNil)
 	if err != nil {
 		return err
 	}
 
-	fullHash, fieldHashes, err := getHashes(fieldInfos)
+	fullHash, fieldHashes, err := getHashes(fieldInfos, opts)
 	if err != nil {
 		return err
 	}
 
-	existingFullHash := uint64FromSlice(existingHash[:8])
+	existingFullHash := uint64FromSlice(body[:8])
 	if existingFullHash == fullHash {
 		return nil
 	}
 
-	existingHammingCode := uint32SliceFromByteSlice(existingHash[8:])
+	// The stored Hamming parity only lines up with fieldHashes' bit
+	// positions if today's field count produces the same number of
+	// parity words as at hash time. When it doesn't -- e.g. an
+	// ",omitempty" field appeared or disappeared, or a nested slice/map
+	// changed length -- the parity can no longer be trusted to localize
+	// anything, so give up the same way an unlocalizable multi-field
+	// change does, instead of comparing mismatched bit positions.
+	if int(log2OfXPlusOne(uint32(len(fieldHashes)))) != hammingCodeLen {
+		return FieldChangedError{}
+	}
+
+	existingHammingCode := uint32SliceFromByteSlice(body[8 : 8+4*hammingCodeLen])
+
+	if opts.Format == FormatV2 {
+		syndromeBytes := body[8+4*hammingCodeLen:]
+		existingSyndromes := uint32SliceFromByteSlice(syndromeBytes)
+
+		found, positions := findChangedFields(fieldHashes, existingHammingCode, existingSyndromes, opts.MaxChanges)
+		if !found {
+			return FieldChangedError{}
+		}
+
+		fields := make([]string, len(positions))
+		for i, p := range positions {
+			fields[i] = fieldInfos[p].name
+		}
+
+		return FieldsChangedError{Fields: fields}
+	}
+
 	foundLocation, location := findErrorLocation(fieldHashes, existingHammingCode)
 
 	if !foundLocation {
@@ -6,6 +6,7 @@ import (
 	"math"
 	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -178,6 +179,111 @@ func TestHashStructRandomMultipleFields(t *testing.T) {
 	}
 }
 
+func TestHashStructWithOptions(t *testing.T) {
+	type testStruct struct {
+		Field1 string  `custom:"Field1"`
+		Field2 *string `custom:"Field2"`
+	}
+
+	opts := &HashOptions{
+		TagName: "custom",
+		ZeroNil: true,
+	}
+
+	zero := ""
+	test1 := testStruct{Field1: "test1", Field2: nil}
+	test2 := testStruct{Field1: "test1", Field2: &zero}
+
+	hash, err := HashStructWithOptions(&test1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStructWithOptions(&test2, hash, opts); err != nil {
+		t.Errorf("expected nil pointer and pointer to zero value to hash the same, got: %v", err)
+	}
+
+	if err := CompareHashStructWithOptions(&test1, hash, nil); err == nil {
+		t.Error("expected an error when comparing against a hash produced with a different TagName")
+	}
+
+	wrongFormat := *opts
+	wrongFormat.Format = FormatV1 + 1
+	if err := CompareHashStructWithOptions(&test1, hash, &wrongFormat); err == nil {
+		t.Error("expected an error when the requested format does not match the hash's format")
+	}
+}
+
+func TestHashStructFormatV2(t *testing.T) {
+	type testStruct struct {
+		Field1 string `infohash:"Field1"`
+		Field2 string `infohash:"Field2"`
+		Field3 string `infohash:"Field3"`
+		Field4 string `infohash:"Field4"`
+		Field5 string `infohash:"Field5"`
+		Field6 string `infohash:"Field6"`
+		Field7 string `infohash:"Field7"`
+		Field8 string `infohash:"Field8"`
+	}
+
+	opts := &HashOptions{Format: FormatV2}
+
+	test1 := testStruct{
+		Field1: "test1", Field2: "test2", Field3: "test3", Field4: "test4",
+		Field5: "test5", Field6: "test6", Field7: "test7", Field8: "test8",
+	}
+
+	hash, err := HashStructWithOptions(&test1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStructWithOptions(&test1, hash, opts); err != nil {
+		t.Errorf("expected the unchanged struct to match, got: %v", err)
+	}
+
+	test2 := test1
+	test2.Field3 = "Field3 changed"
+
+	err = CompareHashStructWithOptions(&test2, hash, opts)
+	fcErr, ok := err.(FieldsChangedError)
+	if !ok {
+		t.Fatalf("expected a FieldsChangedError, got: %v", err)
+	}
+	if len(fcErr.Fields) != 1 || fcErr.Fields[0] != "Field3" {
+		t.Fatalf("expected [\"Field3\"], got: %v", fcErr.Fields)
+	}
+
+	test3 := test1
+	test3.Field2 = "Field2 changed"
+	test3.Field6 = "Field6 changed"
+
+	err = CompareHashStructWithOptions(&test3, hash, opts)
+	fcErr, ok = err.(FieldsChangedError)
+	if !ok {
+		t.Fatalf("expected a FieldsChangedError, got: %v", err)
+	}
+	sort.Strings(fcErr.Fields)
+	if len(fcErr.Fields) != 2 || fcErr.Fields[0] != "Field2" || fcErr.Fields[1] != "Field6" {
+		t.Fatalf("expected [\"Field2\" \"Field6\"], got: %v", fcErr.Fields)
+	}
+
+	test4 := test1
+	test4.Field1 = "Field1 changed"
+	test4.Field4 = "Field4 changed"
+	test4.Field7 = "Field7 changed"
+
+	err = CompareHashStructWithOptions(&test4, hash, opts)
+	if _, ok := err.(FieldChangedError); !ok {
+		t.Fatalf("expected the 3-field change to fall back to FieldChangedError{}, got: %v", err)
+	}
+
+	wrongMaxChanges := HashOptions{Format: FormatV1, MaxChanges: 2}
+	if err := wrongMaxChanges.validate(); err == nil {
+		t.Error("expected an error when MaxChanges > 1 is combined with FormatV1")
+	}
+}
+
 func TestHashStatic(t *testing.T) {
 	type testStruct struct {
 		Field1  string   `infohash:"Field1"`
@@ -207,7 +313,7 @@ func TestHashStatic(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if hex.EncodeToString(hash) != "5d69bd36c3021e652f75a61a8bfcacedd54dff048b9eb95c" {
+	if hex.EncodeToString(hash) != "0104005d69bd36c3021e652f75a61a8bfcacedd54dff048b9eb95c" {
 		t.Fatal("hash is wrong")
 	}
 }
@@ -224,16 +330,18 @@ func TestHashLength(t *testing.T) {
 		return infos
 	}
 
+	opts := (*HashOptions)(nil).withDefaults()
+
 	for i := 0; i < 128; i++ {
-		hash, err := hashInfo(makeInfos(i))
+		hash, err := hashInfo(makeInfos(i), opts)
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		log2NumberOfFieldsPlusOne := int(math.Ceil(math.Log2(float64(i + 1))))
 
-		if len(hash) != (64+log2NumberOfFieldsPlusOne*32)/8 {
-			t.Fatalf("the hash length is wrong: %d != %d", len(hash), (64+log2NumberOfFieldsPlusOne*32)/8)
+		if len(hash) != 3+(64+log2NumberOfFieldsPlusOne*32)/8 {
+			t.Fatalf("the hash length is wrong: %d != %d", len(hash), 3+(64+log2NumberOfFieldsPlusOne*32)/8)
 		}
 
 		// hash length in case we would store a hash for each field:
@@ -334,11 +442,33 @@ func TestGetFieldInfos(t *testing.T) {
 			},
 			err: "the field Field1 has no tag infohash",
 		},
+		{
+			gen: func() (interface{}, []fieldInfo) {
+				obj := &struct {
+					Field1 string `infohash:"-"`
+					Field2 string `infohash:"Field2"`
+				}{}
+				return obj, []fieldInfo{
+					newFieldInfo("Field2", &obj.Field2),
+				}
+			},
+		},
+		{
+			gen: func() (interface{}, []fieldInfo) {
+				obj := &struct {
+					Field1 string `infohash:"Field1,omitempty"`
+					Field2 string `infohash:"Field2"`
+				}{Field2: "test2"}
+				return obj, []fieldInfo{
+					newFieldInfo("Field2", &obj.Field2),
+				}
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		obj, targetInfos := tc.gen()
-		infos, err := getFieldInfos(obj)
+		infos, err := getFieldInfos(obj, tagName, false)
 		if tc.err != "" && err == nil {
 			t.Error("the error is nil, but it should not be")
 		} else if tc.err == "" && err != nil {
@@ -362,3 +492,330 @@ func TestGetFieldInfos(t *testing.T) {
 		}
 	}
 }
+
+func TestHashStructNested(t *testing.T) {
+	type container struct {
+		Name  string `infohash:"Name"`
+		Image string `infohash:"Image"`
+	}
+
+	type podSpec struct {
+		Containers []container `infohash:"Containers"`
+	}
+
+	type pod struct {
+		Name string  `infohash:"Name"`
+		Spec podSpec `infohash:"Spec"`
+	}
+
+	test1 := pod{
+		Name: "pod1",
+		Spec: podSpec{
+			Containers: []container{
+				{Name: "c1", Image: "image1"},
+				{Name: "c2", Image: "image2"},
+			},
+		},
+	}
+
+	hash, err := HashStruct(&test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test2 := test1
+	test2.Spec.Containers = []container{
+		{Name: "c1", Image: "image1"},
+		{Name: "c2", Image: "image2-changed"},
+	}
+
+	err = CompareHashStruct(&test2, hash)
+	fcErr, ok := err.(FieldChangedError)
+	if !ok {
+		t.Fatalf("expected a FieldChangedError, got: %v", err)
+	}
+
+	if fcErr.Field != "Spec.Containers[].Image" {
+		t.Fatalf("expected the dotted field path %q, got %q", "Spec.Containers[].Image", fcErr.Field)
+	}
+
+	if err := CompareHashStruct(&test1, hash); err != nil {
+		t.Fatalf("expected the unchanged struct to match, got: %v", err)
+	}
+}
+
+func TestHashStructNestedPointerZeroNil(t *testing.T) {
+	type child struct {
+		Name string `infohash:"Name"`
+	}
+
+	type parent struct {
+		Child *child `infohash:"Child"`
+	}
+
+	nilChild := parent{Child: nil}
+	zeroChild := parent{Child: &child{}}
+
+	hash, err := HashStruct(&nilChild)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStruct(&zeroChild, hash); err == nil {
+		t.Error("expected a nil nested pointer and a pointer to a zero-value struct to hash differently")
+	}
+
+	opts := &HashOptions{ZeroNil: true}
+
+	hashWithZeroNil, err := HashStructWithOptions(&nilChild, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStructWithOptions(&zeroChild, hashWithZeroNil, opts); err != nil {
+		t.Errorf("expected ZeroNil to make a nil nested pointer and a pointer to a zero-value struct hash the same, got: %v", err)
+	}
+}
+
+func TestHashStructNestedSliceElemZeroNil(t *testing.T) {
+	type child struct {
+		Name string `infohash:"Name"`
+	}
+
+	type parent struct {
+		Children []*child `infohash:"Children"`
+	}
+
+	nilElem := parent{Children: []*child{nil}}
+	zeroElem := parent{Children: []*child{{}}}
+
+	hash, err := HashStruct(&nilElem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStruct(&zeroElem, hash); err == nil {
+		t.Error("expected a nil slice element and a pointer to a zero-value struct to hash differently")
+	}
+
+	opts := &HashOptions{ZeroNil: true}
+
+	hashWithZeroNil, err := HashStructWithOptions(&nilElem, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStructWithOptions(&zeroElem, hashWithZeroNil, opts); err != nil {
+		t.Errorf("expected ZeroNil to make a nil slice element and a pointer to a zero-value struct hash the same, got: %v", err)
+	}
+}
+
+func TestHashStructNestedMapValueZeroNil(t *testing.T) {
+	type child struct {
+		Name string `infohash:"Name"`
+	}
+
+	type parent struct {
+		Children map[string]*child `infohash:"Children"`
+	}
+
+	nilElem := parent{Children: map[string]*child{"a": nil}}
+	zeroElem := parent{Children: map[string]*child{"a": {}}}
+
+	hash, err := HashStruct(&nilElem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStruct(&zeroElem, hash); err == nil {
+		t.Error("expected a nil map value and a pointer to a zero-value struct to hash differently")
+	}
+
+	opts := &HashOptions{ZeroNil: true}
+
+	hashWithZeroNil, err := HashStructWithOptions(&nilElem, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStructWithOptions(&zeroElem, hashWithZeroNil, opts); err != nil {
+		t.Errorf("expected ZeroNil to make a nil map value and a pointer to a zero-value struct hash the same, got: %v", err)
+	}
+}
+
+func TestHashStructNestedStringTag(t *testing.T) {
+	type child struct {
+		Count int `infohash:"Count,string"`
+	}
+
+	type parent struct {
+		Child child `infohash:"Child"`
+	}
+
+	obj := &parent{Child: child{Count: 5}}
+
+	infos, err := getFieldInfos(obj, tagName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, info := range infos {
+		if info.name != "Child.Count" {
+			continue
+		}
+		found = true
+		if !info.asString {
+			t.Error("expected the nested field to keep its ,string tag option")
+		}
+	}
+
+	if !found {
+		t.Fatal("expected a \"Child.Count\" fieldInfo")
+	}
+}
+
+func TestHashStructTagOptions(t *testing.T) {
+	type testStruct struct {
+		Field1 string `infohash:"Field1"`
+		Field2 string `infohash:"Field2,omitempty"`
+		Field3 int    `infohash:"Field3,string"`
+		Field4 string `infohash:"-"`
+	}
+
+	test1 := testStruct{Field1: "test1", Field3: 5, Field4: "ignored"}
+
+	hash, err := HashStruct(&test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A "-" tagged field never contributes to the hash, so changing it
+	// must not produce an error.
+	test2 := test1
+	test2.Field4 = "also ignored"
+	if err := CompareHashStruct(&test2, hash); err != nil {
+		t.Errorf("expected changing an ignored field to have no effect, got: %v", err)
+	}
+
+	// An omitempty field left at its zero value must hash the same as
+	// when the field did not exist at all.
+	type withoutField2 struct {
+		Field1 string `infohash:"Field1"`
+		Field3 int    `infohash:"Field3,string"`
+		Field4 string `infohash:"-"`
+	}
+	reduced := withoutField2{Field1: "test1", Field3: 5, Field4: "ignored"}
+	if err := CompareHashStruct(&reduced, hash); err != nil {
+		t.Errorf("expected a zero-valued omitempty field to hash the same as a struct without it, got: %v", err)
+	}
+
+	// Setting the omitempty field to a non-zero value must be detected.
+	test3 := test1
+	test3.Field2 = "now set"
+	if err := CompareHashStruct(&test3, hash); err == nil {
+		t.Error("expected setting an omitempty field away from its zero value to be detected")
+	}
+}
+
+// TestHashStructOmitemptyFieldCountChange guards against the field count
+// at compare time landing on a different number of Hamming parity words
+// than at hash time. An omitempty field appearing or disappearing (or a
+// nested slice/map changing length) between hash and compare must not
+// panic, and must not misattribute the change to an unrelated field.
+func TestHashStructOmitemptyFieldCountChange(t *testing.T) {
+	type testStruct struct {
+		Field1 string `infohash:"Field1"`
+		Field2 string `infohash:"Field2"`
+		Field3 string `infohash:"Field3"`
+		Field4 string `infohash:"Field4,omitempty"`
+	}
+
+	test1 := testStruct{Field1: "test1", Field2: "test2", Field3: "test3"}
+
+	hash, err := HashStruct(&test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Growing the field count at compare time must not panic.
+	grown := test1
+	grown.Field4 = "now set"
+	if err := CompareHashStruct(&grown, hash); err == nil {
+		t.Error("expected the newly populated omitempty field to be detected as a change")
+	}
+
+	// Shrinking the field count at compare time (relative to a hash taken
+	// with the omitempty field set) must not panic, nor blame a field
+	// that never changed.
+	hashWithField4, err := HashStruct(&grown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shrunk := grown
+	shrunk.Field4 = ""
+
+	err = CompareHashStruct(&shrunk, hashWithField4)
+	if err == nil {
+		t.Fatal("expected clearing the omitempty field to be detected as a change")
+	}
+
+	if fcErr, ok := err.(FieldChangedError); ok && fcErr.Field != "" {
+		t.Fatalf("expected an unlocalized change once the field count shifts, got field %q", fcErr.Field)
+	}
+}
+
+type hashableStub struct {
+	calls int
+}
+
+func (h *hashableStub) InfoHash() ([]byte, error) {
+	h.calls++
+	return []byte("stub-hash"), nil
+}
+
+func TestHashStructHashable(t *testing.T) {
+	type testStruct struct {
+		Field1 hashableStub `infohash:"Field1"`
+	}
+
+	test1 := testStruct{}
+	test2 := testStruct{}
+
+	hash1, err := HashStruct(&test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStruct(&test2, hash1); err != nil {
+		t.Fatalf("expected two stubs that both hash to the same bytes to match, got: %v", err)
+	}
+
+	if test1.Field1.calls == 0 {
+		t.Error("expected InfoHash to be called instead of falling back to spew")
+	}
+}
+
+func TestHashStructHashablePointerField(t *testing.T) {
+	type testStruct struct {
+		Field1 *hashableStub `infohash:"Field1"`
+	}
+
+	stub := &hashableStub{}
+	test1 := testStruct{Field1: stub}
+	test2 := testStruct{Field1: &hashableStub{}}
+
+	hash1, err := HashStruct(&test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashStruct(&test2, hash1); err != nil {
+		t.Fatalf("expected two stubs that both hash to the same bytes to match, got: %v", err)
+	}
+
+	if stub.calls == 0 {
+		t.Error("expected InfoHash to be called on the pointer-typed field instead of falling back to spew")
+	}
+}
@@ -0,0 +1,219 @@
+package infohash
+
+import "fmt"
+
+// FieldsChangedError is returned by CompareHashStructWithOptions under
+// FormatV2 when between one and HashOptions.MaxChanges fields changed at
+// once. Fields holds their tag names (or dotted paths for fields nested
+// inside a tagged struct), in no particular order.
+//
+// A FormatV2 comparison falls back to the original, empty FieldChangedError
+// when more than MaxChanges fields changed, since that many simultaneous
+// changes can no longer be told apart from the syndromes alone.
+type FieldsChangedError struct {
+	Fields []string
+}
+
+func (e FieldsChangedError) Error() string {
+	if len(e.Fields) == 1 {
+		return fmt.Sprintf("the field %q's value changed", e.Fields[0])
+	}
+
+	return fmt.Sprintf("%d fields' values changed: %v", len(e.Fields), e.Fields)
+}
+
+// findChangedFields localizes which of the current fieldHashes changed,
+// given the Hamming parity and extra syndromes stored in a FormatV2
+// hash. It tries every combination of 1..maxChanges field positions,
+// smallest first, solving the linear system the Hamming parity
+// difference implies for that combination's deltas and accepting it
+// once that solution also reproduces the syndrome difference exactly.
+//
+// It returns ok=false when no combination of size <= maxChanges explains
+// the difference, mirroring FormatV1's "more than one field changed"
+// fallback but for larger groups.
+func findChangedFields(fieldHashes []uint32, hammingCode, syndromes []uint32, maxChanges int) (ok bool, positions []int) {
+	n := len(fieldHashes)
+
+	currentHammingCode := calculateHammingCode(fieldHashes)
+	hammingDiff := make([]uint32, len(hammingCode))
+	for i := range hammingDiff {
+		hammingDiff[i] = hammingCode[i] ^ currentHammingCode[i]
+	}
+
+	currentSyndromes := calculateSyndromes(fieldHashes, maxChanges)
+	syndromeDiff := make([]uint32, len(syndromes))
+	for i := range syndromeDiff {
+		syndromeDiff[i] = syndromes[i] ^ currentSyndromes[i]
+	}
+
+	for k := 1; k <= maxChanges && k <= n; k++ {
+		if positions, ok := trySize(n, k, hammingDiff, syndromeDiff); ok {
+			return true, positions
+		}
+	}
+
+	return false, nil
+}
+
+// trySize brute-forces every combination of k field positions (out of
+// n), looking for one whose bit pattern makes hammingDiff solvable for
+// exactly k deltas, and whose solution also reproduces syndromeDiff.
+func trySize(n, k int, hammingDiff, syndromeDiff []uint32) (positions []int, ok bool) {
+	var result []int
+	found := false
+
+	forEachCombination(n, k, func(candidate []int) bool {
+		deltas, solved := solveHammingSystem(candidate, hammingDiff)
+		if !solved {
+			return true
+		}
+
+		if !verifySyndromes(candidate, deltas, syndromeDiff) {
+			return true
+		}
+
+		found = true
+		result = append([]int(nil), candidate...)
+
+		return false
+	})
+
+	return result, found
+}
+
+// forEachCombination calls visit with every k-element, strictly
+// increasing combination of positions in [0, n), stopping early if visit
+// returns false.
+func forEachCombination(n, k int, visit func(candidate []int) bool) {
+	if k <= 0 || k > n {
+		return
+	}
+
+	candidate := make([]int, k)
+	for i := range candidate {
+		candidate[i] = i
+	}
+
+	for {
+		if !visit(candidate) {
+			return
+		}
+
+		i := k - 1
+		for i >= 0 && candidate[i] == n-k+i {
+			i--
+		}
+		if i < 0 {
+			return
+		}
+
+		candidate[i]++
+		for j := i + 1; j < k; j++ {
+			candidate[j] = candidate[j-1] + 1
+		}
+	}
+}
+
+// solveHammingSystem solves, over GF(2) with 32-bit-wide entries, the
+// linear system that the bit-indexed Hamming parity implies for the
+// delta (old XOR new value) at each of the given field positions:
+//
+//	for each parity row i: hammingDiff[i] == XOR over candidate positions
+//	p with bit i set of delta[p]
+//
+// It returns ok=false when the system is inconsistent, or
+// underdetermined (fewer independent rows than unknowns) -- both of
+// which mean this candidate can't be reliably localized.
+func solveHammingSystem(candidate []int, hammingDiff []uint32) (deltas []uint32, ok bool) {
+	k := len(candidate)
+	rows := len(hammingDiff)
+
+	coeffs := make([][]bool, rows)
+	values := make([]uint32, rows)
+	for i := 0; i < rows; i++ {
+		coeffs[i] = make([]bool, k)
+		for j, pos := range candidate {
+			coeffs[i][j] = (pos+1)&(1<<i) != 0
+		}
+		values[i] = hammingDiff[i]
+	}
+
+	rank := 0
+	for col := 0; col < k && rank < rows; col++ {
+		pivot := -1
+		for r := rank; r < rows; r++ {
+			if coeffs[r][col] {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			continue
+		}
+
+		coeffs[rank], coeffs[pivot] = coeffs[pivot], coeffs[rank]
+		values[rank], values[pivot] = values[pivot], values[rank]
+
+		for r := 0; r < rows; r++ {
+			if r != rank && coeffs[r][col] {
+				for c := 0; c < k; c++ {
+					coeffs[r][c] = coeffs[r][c] != coeffs[rank][c]
+				}
+				values[r] ^= values[rank]
+			}
+		}
+
+		rank++
+	}
+
+	if rank < k {
+		return nil, false
+	}
+
+	for r := rank; r < rows; r++ {
+		allZero := true
+		for _, c := range coeffs[r] {
+			if c {
+				allZero = false
+				break
+			}
+		}
+		if allZero && values[r] != 0 {
+			return nil, false
+		}
+	}
+
+	deltas = make([]uint32, k)
+	for r := 0; r < k; r++ {
+		for c := 0; c < k; c++ {
+			if coeffs[r][c] {
+				deltas[c] = values[r]
+				break
+			}
+		}
+	}
+
+	return deltas, true
+}
+
+// verifySyndromes checks that the deltas solveHammingSystem found for
+// candidate also reproduce the observed syndrome difference, which is
+// what gives findChangedFields confidence beyond the Hamming parity
+// alone.
+func verifySyndromes(candidate []int, deltas []uint32, syndromeDiff []uint32) bool {
+	for k := range syndromeDiff {
+		base := gfPow(gfAlpha, k+1)
+
+		var predicted uint32
+		for j, pos := range candidate {
+			predicted ^= gfMul(deltas[j], gfPow(base, pos+1))
+		}
+
+		if predicted != syndromeDiff[k] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,200 @@
+package infohash
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// expandNestedFieldInfos expands a field into a list of leaf fieldInfos
+// named "name.Child" when the field's type is itself a struct carrying
+// tagName tags, or "name[].Child" when that struct is reached through a
+// slice, array, or map. It returns expanded=false when the field should
+// be hashed as a single opaque value instead, which is the case for any
+// field whose type (or element type) is not such a struct.
+//
+// Expanding a field this way lets HashStruct protect every leaf field
+// individually with the Hamming parity code, and lets CompareHashStruct
+// report the full dotted path of whichever leaf changed.
+func expandNestedFieldInfos(tagName, name string, fieldValue reflect.Value, zeroNil bool) ([]fieldInfo, bool, error) {
+	switch fieldValue.Kind() {
+	case reflect.Ptr:
+		elemType := fieldValue.Type().Elem()
+		if elemType.Kind() != reflect.Struct || !structHasTag(elemType, tagName) {
+			return nil, false, nil
+		}
+
+		if fieldValue.IsNil() && !zeroNil {
+			// Without ZeroNil, a nil pointer must keep hashing
+			// differently from a pointer to a zero-value struct, the
+			// same distinction zeroNilValue draws for opaque pointer
+			// fields. Expanding into manufactured zero-value leaves
+			// here would make the two indistinguishable, so fall back
+			// to hashing the nil pointer itself as a single opaque
+			// value instead.
+			return nil, false, nil
+		}
+
+		elem := fieldValue
+		if elem.IsNil() {
+			elem = reflect.New(elemType)
+		}
+
+		nested, err := getStructFieldInfos(elem.Elem(), tagName, zeroNil)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return prefixFieldInfos(name+".", nested), true, nil
+
+	case reflect.Struct:
+		if !structHasTag(fieldValue.Type(), tagName) {
+			return nil, false, nil
+		}
+
+		nested, err := getStructFieldInfos(fieldValue, tagName, zeroNil)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return prefixFieldInfos(name+".", nested), true, nil
+
+	case reflect.Slice, reflect.Array:
+		structType, isPtr := derefStructType(fieldValue.Type().Elem())
+		if structType == nil || !structHasTag(structType, tagName) {
+			return nil, false, nil
+		}
+
+		var out []fieldInfo
+		for i := 0; i < fieldValue.Len(); i++ {
+			elem := fieldValue.Index(i)
+			if isPtr {
+				if elem.IsNil() && !zeroNil {
+					// Mirror the Ptr case above: without ZeroNil, a nil
+					// element must keep hashing differently from a
+					// pointer to a zero-value struct, so hash it as a
+					// single opaque value instead of expanding it into
+					// zero-value leaves indistinguishable from an
+					// explicitly zeroed element.
+					out = append(out, fieldInfo{
+						name:       name + "[]",
+						fieldValue: elem.Addr().Interface(),
+					})
+					continue
+				}
+
+				if elem.IsNil() {
+					elem = reflect.New(structType)
+				}
+				elem = elem.Elem()
+			}
+
+			nested, err := getStructFieldInfos(elem, tagName, zeroNil)
+			if err != nil {
+				return nil, false, err
+			}
+
+			out = append(out, prefixFieldInfos(name+"[].", nested)...)
+		}
+
+		return out, true, nil
+
+	case reflect.Map:
+		structType, isPtr := derefStructType(fieldValue.Type().Elem())
+		if structType == nil || !structHasTag(structType, tagName) {
+			return nil, false, nil
+		}
+
+		keys := fieldValue.MapKeys()
+		sort.Slice(keys, func(a, b int) bool {
+			return fmt.Sprintf("%#v", keys[a].Interface()) < fmt.Sprintf("%#v", keys[b].Interface())
+		})
+
+		var out []fieldInfo
+		for _, key := range keys {
+			mapValue := fieldValue.MapIndex(key)
+
+			if isPtr && mapValue.IsNil() && !zeroNil {
+				// Mirror the Ptr case above: without ZeroNil, a nil
+				// value must keep hashing differently from a pointer
+				// to a zero-value struct, so hash it as a single
+				// opaque value instead of expanding it into zero-value
+				// leaves indistinguishable from an explicitly zeroed
+				// value.
+				addressable := reflect.New(mapValue.Type())
+				addressable.Elem().Set(mapValue)
+
+				out = append(out, fieldInfo{
+					name:       name + "[]",
+					fieldValue: addressable.Interface(),
+				})
+				continue
+			}
+
+			elem := reflect.New(structType).Elem()
+			if isPtr {
+				if !mapValue.IsNil() {
+					elem.Set(mapValue.Elem())
+				}
+			} else {
+				elem.Set(mapValue)
+			}
+
+			nested, err := getStructFieldInfos(elem, tagName, zeroNil)
+			if err != nil {
+				return nil, false, err
+			}
+
+			out = append(out, prefixFieldInfos(name+"[].", nested)...)
+		}
+
+		return out, true, nil
+
+	default:
+		return nil, false, nil
+	}
+}
+
+// derefStructType returns the struct type reached by t, and whether it
+// was reached through a pointer. It returns a nil type when t is
+// neither a struct nor a pointer to one.
+func derefStructType(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() == reflect.Ptr {
+		if t.Elem().Kind() != reflect.Struct {
+			return nil, false
+		}
+		return t.Elem(), true
+	}
+
+	if t.Kind() == reflect.Struct {
+		return t, false
+	}
+
+	return nil, false
+}
+
+// structHasTag reports whether t has at least one field tagged with
+// tagName, which is what makes a field of type t a candidate for
+// expansion by expandNestedFieldInfos.
+func structHasTag(t reflect.Type, tagName string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get(tagName) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func prefixFieldInfos(prefix string, infos []fieldInfo) []fieldInfo {
+	out := make([]fieldInfo, len(infos))
+	for i, info := range infos {
+		out[i] = fieldInfo{
+			name:       prefix + info.name,
+			fieldValue: info.fieldValue,
+			asString:   info.asString,
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,114 @@
+package infohash
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+)
+
+// Format identifies the on-disk encoding of a hash produced by this
+// package. It is stored as the first byte of every hash returned by
+// HashStructWithOptions so that CompareHashStructWithOptions can detect
+// a hash that was produced with an incompatible encoding instead of
+// silently misinterpreting its bytes.
+type Format uint8
+
+const (
+	// FormatV1 is the original encoding: an 8-byte hash of all fields
+	// followed by log2(len(fields)+1) Hamming-code parity words, one per
+	// bit of error location. It can only ever localize a single changed
+	// field; two or more changes give FieldChangedError{} unless their
+	// combined parity difference happens to point at a valid position,
+	// in which case that position's field is reported.
+	FormatV1 Format = iota + 1
+
+	// FormatV2 extends FormatV1 with HashOptions.MaxChanges-1 extra
+	// GF(2^32) syndrome words appended after the Hamming parity, which
+	// let CompareHashStructWithOptions localize up to MaxChanges
+	// simultaneous field changes instead of just one. See
+	// findChangedFields for the decoding side.
+	FormatV2
+)
+
+// HashOptions configures HashStructWithOptions and
+// CompareHashStructWithOptions. A nil *HashOptions is equivalent to the
+// zero value, and missing fields fall back to the defaults documented
+// below.
+type HashOptions struct {
+	// Hasher constructs the hash used to produce the overall hash of
+	// every field's name and value. Defaults to fnv.New64a.
+	Hasher func() hash.Hash64
+
+	// FieldHasher constructs the hash used to produce each field's own
+	// hash, from which the Hamming parity words are computed. Defaults
+	// to fnv.New32a.
+	FieldHasher func() hash.Hash32
+
+	// TagName is the struct tag read by getFieldInfos. Defaults to
+	// "infohash".
+	TagName string
+
+	// Format selects the on-disk encoding of the returned hash.
+	// Defaults to FormatV1.
+	Format Format
+
+	// ZeroNil makes a nil pointer field hash identically to a pointer
+	// to the zero value of the same type, so that code which sometimes
+	// leaves a field nil and sometimes sets it to its zero value does
+	// not produce spurious FieldChangedErrors. This also applies to a
+	// nested struct pointer field expanded by expandNestedFieldInfos:
+	// without ZeroNil, a nil nested pointer is hashed as a single
+	// opaque value instead of being expanded into (necessarily
+	// identical) zero-value leaves.
+	ZeroNil bool
+
+	// MaxChanges is the number of simultaneous field changes that
+	// CompareHashStructWithOptions can localize. It only applies to
+	// FormatV2, where it defaults to 2; FormatV1 always behaves as if
+	// it were 1, and setting it above 1 for FormatV1 is an error.
+	// A group of three or more changed fields is only localized when
+	// the Hamming bit patterns of their positions are linearly
+	// independent; otherwise the comparison returns FieldChangedError{}.
+	MaxChanges int
+}
+
+// withDefaults returns a copy of o with every unset field replaced by
+// its default, so callers never have to nil-check individual options.
+func (o *HashOptions) withDefaults() *HashOptions {
+	var out HashOptions
+	if o != nil {
+		out = *o
+	}
+
+	if out.Hasher == nil {
+		out.Hasher = fnv.New64a
+	}
+	if out.FieldHasher == nil {
+		out.FieldHasher = fnv.New32a
+	}
+	if out.TagName == "" {
+		out.TagName = tagName
+	}
+	if out.Format == 0 {
+		out.Format = FormatV1
+	}
+	if out.MaxChanges == 0 {
+		if out.Format == FormatV2 {
+			out.MaxChanges = 2
+		} else {
+			out.MaxChanges = 1
+		}
+	}
+
+	return &out
+}
+
+// validate reports an error for option combinations that withDefaults
+// cannot silently paper over.
+func (o *HashOptions) validate() error {
+	if o.Format == FormatV1 && o.MaxChanges > 1 {
+		return fmt.Errorf("MaxChanges can only be set above 1 when using FormatV2")
+	}
+
+	return nil
+}
@@ -0,0 +1,369 @@
+// Package proto mirrors the infohash API for protobuf messages. Instead
+// of Go struct tags, fields are keyed off their protobuf field numbers,
+// which makes it usable directly on generated message types without
+// having to mirror them into tagged Go structs.
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/inteon/infohash"
+)
+
+// FieldChangedError is returned by CompareHashMessage when the hash does
+// not match. Field holds the changed field's name, as given by the
+// message's protobuf descriptor, or is empty when the change could not
+// be localized to a single field.
+type FieldChangedError struct {
+	Field string
+}
+
+func (e FieldChangedError) Error() string {
+	if e.Field == "" {
+		return "a field value changed"
+	}
+
+	return fmt.Sprintf("the field %q's value changed", e.Field)
+}
+
+type fieldHash struct {
+	name string
+	hash uint32
+}
+
+// HashMessage returns an infohash of the given protobuf message, keyed
+// off its field numbers rather than Go struct tags. Every field declared
+// on m's descriptor is walked in ascending field-number order -- not
+// just the populated ones -- so that the number of per-field hashes
+// never depends on which fields happen to be set. Each field contributes
+// an FNV-32 hash of its field number, wire type, and an explicit
+// present/absent marker followed by its canonical value bytes when
+// present. Repeated fields are hashed as an ordered concatenation of
+// their elements, map fields as a concatenation sorted by hashed key,
+// and nested messages recursively contribute their own HashMessage
+// digest. Every member of a oneof is hashed individually, present or
+// not, like any other field.
+//
+// The per-field hashes are fed into the same Hamming parity scheme as
+// HashStruct, so CompareHashMessage can localize a single changed field
+// by name via the message's descriptor.
+func HashMessage(m proto.Message) ([]byte, error) {
+	fieldHashes, err := getFieldHashes(m)
+	if err != nil {
+		return nil, err
+	}
+
+	fullHash, hashes := combineFieldHashes(fieldHashes)
+	parity := infohash.CalculateParity(hashes)
+
+	combined := make([]byte, 0, 8+4*len(parity))
+	combined = binary.BigEndian.AppendUint64(combined, fullHash)
+	for _, p := range parity {
+		combined = binary.BigEndian.AppendUint32(combined, p)
+	}
+
+	return combined, nil
+}
+
+// CompareHashMessage compares the hash of m against a previously
+// computed hash.
+//
+// If the hash matches, it returns nil. If the hash does not match, it
+// returns a FieldChangedError. If exactly one field changed, the error
+// names that field. If more than one field changed, the error's Field
+// is usually empty; it names an unrelated field when the combined parity
+// difference happens to point at a valid field position.
+func CompareHashMessage(m proto.Message, existing []byte) error {
+	if len(existing) < 8 {
+		return fmt.Errorf("the existing hash is too short")
+	}
+
+	fieldHashes, err := getFieldHashes(m)
+	if err != nil {
+		return err
+	}
+
+	fullHash, hashes := combineFieldHashes(fieldHashes)
+	if fullHash == binary.BigEndian.Uint64(existing[:8]) {
+		return nil
+	}
+
+	parity := decodeParity(existing[8:])
+
+	// The stored parity only lines up with hashes' bit positions if
+	// today's descriptor produces the same number of parity words as at
+	// hash time. When it doesn't -- e.g. a field was added to or removed
+	// from the message's schema between the two -- FindChangedField
+	// would index past the parity it computes from today's field count,
+	// so give up the same way an unlocalizable multi-field change does.
+	if len(parity) != len(infohash.CalculateParity(hashes)) {
+		return FieldChangedError{}
+	}
+
+	found, position := infohash.FindChangedField(hashes, parity)
+	if !found {
+		return FieldChangedError{}
+	}
+
+	return FieldChangedError{
+		Field: fieldHashes[position].name,
+	}
+}
+
+// combineFieldHashes returns the overall FNV-64a hash of every per-field
+// hash, in order, alongside the per-field hashes themselves.
+func combineFieldHashes(fieldHashes []fieldHash) (uint64, []uint32) {
+	fullHash := fnv.New64a()
+	hashes := make([]uint32, len(fieldHashes))
+
+	for i, f := range fieldHashes {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], f.hash)
+		_, _ = fullHash.Write(b[:])
+
+		hashes[i] = f.hash
+	}
+
+	return fullHash.Sum64(), hashes
+}
+
+func decodeParity(b []byte) []uint32 {
+	out := make([]uint32, len(b)/4)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint32(b[i*4 : i*4+4])
+	}
+
+	return out
+}
+
+// getFieldHashes walks every field declared on m's descriptor, in
+// ascending field-number order, and hashes each one -- present or not.
+// Walking the declared fields rather than protoreflect.Message.Range's
+// populated-only fields keeps the number of per-field hashes (and so the
+// Hamming parity layout built from them) independent of which fields
+// happen to be set, e.g. a proto3 scalar cleared back to its zero value.
+func getFieldHashes(m proto.Message) ([]fieldHash, error) {
+	msg := m.ProtoReflect()
+	descriptorFields := msg.Descriptor().Fields()
+
+	fds := make([]protoreflect.FieldDescriptor, descriptorFields.Len())
+	for i := range fds {
+		fds[i] = descriptorFields.Get(i)
+	}
+
+	sort.Slice(fds, func(a, b int) bool {
+		return fds[a].Number() < fds[b].Number()
+	})
+
+	fieldHashes := make([]fieldHash, 0, len(fds))
+	for _, fd := range fds {
+		h, err := hashField(msg, fd)
+		if err != nil {
+			return nil, err
+		}
+
+		fieldHashes = append(fieldHashes, fieldHash{
+			name: string(fd.Name()),
+			hash: h,
+		})
+	}
+
+	return fieldHashes, nil
+}
+
+// hashField computes the FNV-32 hash of (fieldNumber, wireTypeTag,
+// presenceMarker, canonicalValueBytes) for a single field of msg.
+// canonicalValueBytes is omitted entirely when the field is absent, so
+// that an absent field always hashes the same regardless of its type's
+// zero value.
+func hashField(msg protoreflect.Message, fd protoreflect.FieldDescriptor) (uint32, error) {
+	h := fnv.New32a()
+
+	var tag [8]byte
+	binary.BigEndian.PutUint32(tag[0:4], uint32(fd.Number()))
+	binary.BigEndian.PutUint32(tag[4:8], uint32(wireType(fd)))
+	if _, err := h.Write(tag[:]); err != nil {
+		return 0, err
+	}
+
+	if !msg.Has(fd) {
+		if _, err := h.Write([]byte{0}); err != nil {
+			return 0, err
+		}
+		return h.Sum32(), nil
+	}
+	if _, err := h.Write([]byte{1}); err != nil {
+		return 0, err
+	}
+
+	v := msg.Get(fd)
+
+	switch {
+	case fd.IsMap():
+		if err := writeMapValue(h, fd, v.Map()); err != nil {
+			return 0, err
+		}
+	case fd.IsList():
+		if err := writeListValue(h, fd, v.List()); err != nil {
+			return 0, err
+		}
+	default:
+		b, err := canonicalValueBytes(fd, v)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := h.Write(b); err != nil {
+			return 0, err
+		}
+	}
+
+	return h.Sum32(), nil
+}
+
+func writeListValue(h hash.Hash32, fd protoreflect.FieldDescriptor, list protoreflect.List) error {
+	for i := 0; i < list.Len(); i++ {
+		b, err := canonicalValueBytes(fd, list.Get(i))
+		if err != nil {
+			return err
+		}
+
+		if _, err := h.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeMapValue hashes each entry's canonical key and value bytes
+// together, then writes the entries in order of their hashed key so
+// that the result does not depend on map iteration order.
+func writeMapValue(h hash.Hash32, fd protoreflect.FieldDescriptor, m protoreflect.Map) error {
+	keyField, valueField := fd.MapKey(), fd.MapValue()
+
+	type entry struct {
+		keyHash uint32
+		bytes   []byte
+	}
+
+	entries := make([]entry, 0, m.Len())
+
+	var rangeErr error
+	m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		keyBytes, err := canonicalValueBytes(keyField, k.Value())
+		if err != nil {
+			rangeErr = err
+			return false
+		}
+
+		valueBytes, err := canonicalValueBytes(valueField, v)
+		if err != nil {
+			rangeErr = err
+			return false
+		}
+
+		keyHash := fnv.New32a()
+		if _, err := keyHash.Write(keyBytes); err != nil {
+			rangeErr = err
+			return false
+		}
+
+		entries = append(entries, entry{
+			keyHash: keyHash.Sum32(),
+			bytes:   append(keyBytes, valueBytes...),
+		})
+
+		return true
+	})
+	if rangeErr != nil {
+		return rangeErr
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].keyHash < entries[b].keyHash
+	})
+
+	for _, e := range entries {
+		if _, err := h.Write(e.bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wireType returns the protobuf wire type used to encode fd, which is
+// folded into the field's hash alongside its field number so that a
+// field whose type changes (e.g. fixed32 to varint) is detected even if
+// the raw bytes happen to collide.
+func wireType(fd protoreflect.FieldDescriptor) protowire.Type {
+	if fd.IsList() || fd.IsMap() {
+		return protowire.BytesType
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind, protoreflect.EnumKind,
+		protoreflect.Int32Kind, protoreflect.Int64Kind,
+		protoreflect.Uint32Kind, protoreflect.Uint64Kind,
+		protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return protowire.VarintType
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.FloatKind:
+		return protowire.Fixed32Type
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.DoubleKind:
+		return protowire.Fixed64Type
+	default:
+		return protowire.BytesType
+	}
+}
+
+// canonicalValueBytes encodes v in its protobuf canonical form. Nested
+// messages are encoded as the first 8 bytes of their own HashMessage
+// digest rather than their raw wire bytes, so that a change to a deeply
+// nested field is still detected.
+func canonicalValueBytes(fd protoreflect.FieldDescriptor, v protoreflect.Value) ([]byte, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return protowire.AppendVarint(nil, protowire.EncodeBool(v.Bool())), nil
+	case protoreflect.EnumKind:
+		return protowire.AppendVarint(nil, uint64(int64(v.Enum()))), nil
+	case protoreflect.Int32Kind, protoreflect.Int64Kind:
+		return protowire.AppendVarint(nil, uint64(v.Int())), nil
+	case protoreflect.Uint32Kind, protoreflect.Uint64Kind:
+		return protowire.AppendVarint(nil, v.Uint()), nil
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return protowire.AppendVarint(nil, protowire.EncodeZigZag(v.Int())), nil
+	case protoreflect.Fixed32Kind:
+		return protowire.AppendFixed32(nil, uint32(v.Uint())), nil
+	case protoreflect.Sfixed32Kind:
+		return protowire.AppendFixed32(nil, uint32(v.Int())), nil
+	case protoreflect.FloatKind:
+		return protowire.AppendFixed32(nil, math.Float32bits(float32(v.Float()))), nil
+	case protoreflect.Fixed64Kind:
+		return protowire.AppendFixed64(nil, v.Uint()), nil
+	case protoreflect.Sfixed64Kind:
+		return protowire.AppendFixed64(nil, uint64(v.Int())), nil
+	case protoreflect.DoubleKind:
+		return protowire.AppendFixed64(nil, math.Float64bits(v.Float())), nil
+	case protoreflect.StringKind:
+		return protowire.AppendString(nil, v.String()), nil
+	case protoreflect.BytesKind:
+		return protowire.AppendBytes(nil, v.Bytes()), nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		digest, err := HashMessage(v.Message().Interface())
+		if err != nil {
+			return nil, err
+		}
+		return digest[:8], nil
+	default:
+		return nil, fmt.Errorf("infohash/proto: unsupported field kind %v", fd.Kind())
+	}
+}
@@ -0,0 +1,139 @@
+package proto
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestHashMessage(t *testing.T) {
+	test1 := &durationpb.Duration{Seconds: 10, Nanos: 5}
+
+	hash, err := HashMessage(test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashMessage(test1, hash); err != nil {
+		t.Fatalf("expected the unchanged message to match, got: %v", err)
+	}
+
+	test2 := &durationpb.Duration{Seconds: 11, Nanos: 5}
+
+	err = CompareHashMessage(test2, hash)
+	fcErr, ok := err.(FieldChangedError)
+	if !ok {
+		t.Fatalf("expected a FieldChangedError, got: %v", err)
+	}
+
+	if fcErr.Field != "seconds" {
+		t.Fatalf("expected the field %q, got %q", "seconds", fcErr.Field)
+	}
+}
+
+func TestHashMessageMultipleFieldsChanged(t *testing.T) {
+	test1 := &durationpb.Duration{Seconds: 10, Nanos: 5}
+
+	hash, err := HashMessage(test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test2 := &durationpb.Duration{Seconds: 11, Nanos: 6}
+
+	err = CompareHashMessage(test2, hash)
+	fcErr, ok := err.(FieldChangedError)
+	if !ok {
+		t.Fatalf("expected a FieldChangedError, got: %v", err)
+	}
+
+	if fcErr.Field != "" {
+		t.Fatalf("expected the field name to be empty, got %q", fcErr.Field)
+	}
+}
+
+func TestHashMessageClearedToZeroValue(t *testing.T) {
+	test1 := &durationpb.Duration{Seconds: 10, Nanos: 5}
+
+	hash, err := HashMessage(test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clearing a proto3 scalar back to its zero value makes it disappear
+	// from protoreflect.Message.Range, but it must still be detected as
+	// a change rather than desyncing the per-field hash count.
+	test2 := &durationpb.Duration{Seconds: 0, Nanos: 5}
+
+	err = CompareHashMessage(test2, hash)
+	fcErr, ok := err.(FieldChangedError)
+	if !ok {
+		t.Fatalf("expected a FieldChangedError, got: %v", err)
+	}
+
+	if fcErr.Field != "seconds" {
+		t.Fatalf("expected the field %q, got %q", "seconds", fcErr.Field)
+	}
+}
+
+func TestHashMessageParityLengthMismatch(t *testing.T) {
+	test1 := &durationpb.Duration{Seconds: 10, Nanos: 5}
+
+	fieldHashes, err := getFieldHashes(test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullHash, _ := combineFieldHashes(fieldHashes)
+
+	// Simulate a hash produced by a schema version whose descriptor had
+	// more fields than today's two (seconds, nanos), and so stored one
+	// extra parity word. CompareHashMessage must not trust that the
+	// stored parity still lines up with today's field count and must
+	// not panic when it doesn't.
+	existing := make([]byte, 0, 8+4*3)
+	existing = binary.BigEndian.AppendUint64(existing, fullHash+1)
+	for i := 0; i < 3; i++ {
+		existing = binary.BigEndian.AppendUint32(existing, uint32(i))
+	}
+
+	err = CompareHashMessage(test1, existing)
+	if _, ok := err.(FieldChangedError); !ok {
+		t.Fatalf("expected a FieldChangedError, got: %v", err)
+	}
+}
+
+func TestHashMessageMapsAndLists(t *testing.T) {
+	test1, err := structpb.NewStruct(map[string]interface{}{
+		"name":  "test",
+		"tags":  []interface{}{"a", "b"},
+		"count": 1.0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := HashMessage(test1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashMessage(test1, hash); err != nil {
+		t.Fatalf("expected the unchanged message to match, got: %v", err)
+	}
+
+	test2, err := structpb.NewStruct(map[string]interface{}{
+		"name":  "test",
+		"tags":  []interface{}{"a", "b", "c"},
+		"count": 1.0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareHashMessage(test2, hash); err == nil {
+		t.Error("expected an error when a list element was added")
+	}
+}
@@ -0,0 +1,74 @@
+package infohash
+
+// gfPoly is a fixed degree-32 reduction polynomial used to turn XOR
+// ("carry-less add") and carry-less multiplication into the GF(2^32)
+// arithmetic used by calculateSyndromes. It is the CRC-32 polynomial in
+// its normal (MSB-first) form, matching gfMul's left shifts; it does
+// not need to be primitive, since the syndromes it
+// produces are only ever used to double-check a candidate solution
+// found by findChangedFields, never to be algebraically inverted.
+const gfPoly = 0x04C11DB7
+
+// gfAlpha is the fixed generator the power-sum syndromes are evaluated
+// at. Any constant not equal to 0 or 1 works equally well here.
+const gfAlpha = 2
+
+// gfMul multiplies a and b as elements of GF(2^32)/gfPoly.
+func gfMul(a, b uint32) uint32 {
+	var result uint32
+	for b != 0 {
+		if b&1 != 0 {
+			result ^= a
+		}
+
+		highBitSet := a&0x80000000 != 0
+		a <<= 1
+		if highBitSet {
+			a ^= gfPoly
+		}
+
+		b >>= 1
+	}
+
+	return result
+}
+
+// gfPow raises a to the e-th power in GF(2^32)/gfPoly.
+func gfPow(a uint32, e int) uint32 {
+	result := uint32(1)
+	for e > 0 {
+		if e&1 != 0 {
+			result = gfMul(result, a)
+		}
+
+		a = gfMul(a, a)
+		e >>= 1
+	}
+
+	return result
+}
+
+// calculateSyndromes computes the maxChanges-1 extra power-sum syndromes
+// appended after the Hamming parity in FormatV2: for k = 1..maxChanges-1,
+// S_k = XOR over i of fields[i] * alpha^(k*(i+1)). Together with the
+// existing bit-indexed Hamming parity, these give findChangedFields
+// enough independent constraints to localize up to maxChanges
+// simultaneously changed fields instead of just one.
+func calculateSyndromes(fields []uint32, maxChanges int) []uint32 {
+	syndromes := make([]uint32, maxChanges-1)
+
+	for k := 1; k < maxChanges; k++ {
+		base := gfPow(gfAlpha, k)
+		power := base
+
+		var s uint32
+		for _, field := range fields {
+			s ^= gfMul(field, power)
+			power = gfMul(power, base)
+		}
+
+		syndromes[k-1] = s
+	}
+
+	return syndromes
+}